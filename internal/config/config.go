@@ -0,0 +1,72 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// Dendrite is the root of Dendrite's configuration tree.
+type Dendrite struct {
+	Global Global
+	MSCs   MSCs
+}
+
+// Defaults fills in any zero-valued settings across the whole config tree with sane defaults,
+// suitable for tests and for generating a starter config file.
+func (c *Dendrite) Defaults() {
+	c.Global.Defaults()
+	c.MSCs.Defaults()
+}
+
+// Verify checks that the config tree is internally consistent, returning the first error found.
+// It should be called once after loading a config file (after Defaults, which only fills in zero
+// values and can't itself catch a malformed non-zero one).
+func (c *Dendrite) Verify() error {
+	return c.MSCs.Verify()
+}
+
+// Global holds settings that apply across every component.
+type Global struct {
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+}
+
+// Defaults fills in any zero-valued Global settings with sane defaults.
+func (c *Global) Defaults() {
+	if c.ServerName == "" {
+		c.ServerName = "localhost"
+	}
+}
+
+// MSCs holds settings for experimental Matrix Spec Change implementations.
+type MSCs struct {
+	// MSCs lists which experimental MSCs are enabled, e.g. "msc2836".
+	MSCs []string `yaml:"mscs"`
+	// Database is where MSC implementations that need their own storage, e.g. msc2836's thread
+	// index, persist it.
+	Database DatabaseOptions `yaml:"database"`
+	// MaxFederationHops bounds how many times a single msc2836 /event_relationships request will
+	// cross onto a remote server while walking a relationship graph. Zero means msc2836 picks its
+	// own default.
+	MaxFederationHops int `yaml:"max_federation_hops"`
+}
+
+// Defaults fills in any zero-valued MSCs settings with sane defaults.
+func (c *MSCs) Defaults() {
+	c.Database.Defaults()
+}
+
+// Verify checks that MSCs settings are internally consistent.
+func (c *MSCs) Verify() error {
+	return c.Database.Verify()
+}
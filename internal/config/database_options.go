@@ -0,0 +1,101 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxOpenConns           = 90
+	defaultMaxIdleConns           = 5
+	defaultConnMaxLifetimeSeconds = 300
+)
+
+// DataSource is a database connection string, e.g. "file:foo.db" or "postgres://...".
+type DataSource string
+
+// IsSQLite returns true if the connection string points at a SQLite database.
+func (d DataSource) IsSQLite() bool {
+	return strings.HasPrefix(string(d), "file:")
+}
+
+// IsPostgres returns true if the connection string points at a Postgres database.
+func (d DataSource) IsPostgres() bool {
+	return strings.HasPrefix(string(d), "postgres:") || strings.HasPrefix(string(d), "postgresql:")
+}
+
+// DatabaseOptions describes how a single component connects to its database.
+type DatabaseOptions struct {
+	ConnectionString          DataSource `yaml:"connection_string"`
+	MaxOpenConnections        int        `yaml:"max_open_conns"`
+	MaxIdleConnections        int        `yaml:"max_idle_conns"`
+	ConnMaxLifetimeSeconds    int        `yaml:"conn_max_lifetime_seconds"`
+	// ReadReplicas lists additional Postgres connection strings that eligible read-only queries
+	// may be routed to instead of ConnectionString, to spread load away from the primary. Ignored
+	// for SQLite, which has no replication story. See internal/sqlutil for how queries are
+	// chosen and routed.
+	ReadReplicas []DataSource `yaml:"read_replicas"`
+	// ReplicaOverride pins this component to one specific entry of ReadReplicas (matched
+	// verbatim) instead of letting the router pick whichever replica currently has the fewest
+	// in-flight queries. Useful for a component like the syncapi that tolerates less replication
+	// lag than most callers. Leave empty for the default least-in-flight selection.
+	ReplicaOverride DataSource `yaml:"replica_override"`
+}
+
+// Defaults fills in any zero-valued connection pool settings with Dendrite's defaults.
+func (c *DatabaseOptions) Defaults() {
+	if c.MaxOpenConnections <= 0 {
+		c.MaxOpenConnections = defaultMaxOpenConns
+	}
+	if c.MaxIdleConnections <= 0 {
+		c.MaxIdleConnections = defaultMaxIdleConns
+	}
+	if c.ConnMaxLifetimeSeconds <= 0 {
+		c.ConnMaxLifetimeSeconds = defaultConnMaxLifetimeSeconds
+	}
+}
+
+// Verify checks that ReadReplicas/ReplicaOverride are internally consistent.
+func (c *DatabaseOptions) Verify() error {
+	for _, r := range c.ReadReplicas {
+		if !r.IsPostgres() {
+			return fmt.Errorf("config: read replica %q must be a postgres connection string", r)
+		}
+	}
+	if c.ReplicaOverride == "" {
+		return nil
+	}
+	for _, r := range c.ReadReplicas {
+		if r == c.ReplicaOverride {
+			return nil
+		}
+	}
+	return fmt.Errorf("config: replica_override %q is not listed in read_replicas", c.ReplicaOverride)
+}
+
+func (c *DatabaseOptions) MaxOpenConns() int {
+	return c.MaxOpenConnections
+}
+
+func (c *DatabaseOptions) MaxIdleConns() int {
+	return c.MaxIdleConnections
+}
+
+func (c *DatabaseOptions) ConnMaxLifetime() time.Duration {
+	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
+}
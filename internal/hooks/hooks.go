@@ -13,22 +13,113 @@
 // limitations under the License.
 
 // Package hooks exposes places in Dendrite where custom code can be executed, useful for MSCs.
-// Hooks can only be run in monolith mode.
+// In monolith mode, Enable, Attach and Run are enough: callbacks run in-process. In polylith mode, call
+// EnablePublish once from the process that runs the pipeline (usually the roomserver) so Run
+// also publishes each invocation onto the NATS stream, and call Serve from any other process
+// that wants to react to those same events, e.g. an MSC running as its own polylith component.
 package hooks
 
-import "sync"
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Kind identifies a point in Dendrite's processing where a hook may run.
+type Kind string
+
+const (
+	// KindPrePersistEvent is run with *gomatrixserverlib.HeaderedEvent before the roomserver
+	// persists the event. Callbacks may replace the event or reject it outright, e.g. to
+	// implement MSCs that need to veto or rewrite events before they become part of room state.
+	KindPrePersistEvent Kind = "pre_persist_event"
+	// KindPostPersistEvent is run with *gomatrixserverlib.HeaderedEvent once the roomserver has
+	// durably persisted the event. This is the closest equivalent of the old KindNewEvent hook:
+	// callbacks are observers only, their HookAction is ignored.
+	KindPostPersistEvent Kind = "post_persist_event"
+	// KindMembershipChange is run with *gomatrixserverlib.HeaderedEvent whenever an m.room.member
+	// event is persisted.
+	KindMembershipChange Kind = "membership_change"
+	// KindFederationSend is run with *gomatrixserverlib.HeaderedEvent immediately before the
+	// event is handed to the federation sender for outbound delivery.
+	KindFederationSend Kind = "federation_send"
+	// KindEDU is run with *gomatrixserverlib.HeaderedEvent for ephemeral data units, e.g.
+	// typing notifications and receipts, which never reach the roomserver's persistent storage.
+	KindEDU Kind = "edu"
+)
+
+// Callback is the typed signature every hook callback must implement. It returns a HookAction
+// which tells the caller how to proceed with the event: continue unchanged, replace it with a
+// different event, or reject it with a reason.
+type Callback func(event *gomatrixserverlib.HeaderedEvent) (HookAction, error)
+
+// ActionKind distinguishes the possible outcomes of running a hook callback.
+type ActionKind int
 
 const (
-	// KindNewEvent is a hook which is called with *gomatrixserverlib.HeaderedEvent
-	// It is run when a new event is persisted in the roomserver.
-	// Usage:
-	//   hooks.Attach(hooks.KindNewEvent, func(headeredEvent interface{}) { ... })
-	KindNewEvent = "new_event"
+	// ActionContinue means the callback did not want to change anything.
+	ActionContinue ActionKind = iota
+	// ActionReplace means the callback wants the event replaced with a new one.
+	ActionReplace
+	// ActionReject means the callback wants the event rejected outright.
+	ActionReject
 )
 
+// HookAction is returned by a Callback to tell Run how to proceed.
+type HookAction struct {
+	Kind        ActionKind
+	NewEvent    *gomatrixserverlib.HeaderedEvent
+	RejectError error
+}
+
+// Continue lets the event through unchanged.
+func Continue() HookAction {
+	return HookAction{Kind: ActionContinue}
+}
+
+// Replace swaps the event being processed for newEvent.
+func Replace(newEvent *gomatrixserverlib.HeaderedEvent) HookAction {
+	return HookAction{Kind: ActionReplace, NewEvent: newEvent}
+}
+
+// Reject stops the event being processed any further, surfacing reason to the caller.
+func Reject(reason string) HookAction {
+	return HookAction{Kind: ActionReject, RejectError: fmt.Errorf("hooks: event rejected: %s", reason)}
+}
+
+// Handle is returned by Attach and can be used to unregister a callback.
+type Handle struct {
+	kind     Kind
+	id       uint64
+	priority int
+}
+
+// Unregister removes the callback associated with this Handle. It is a no-op if the callback
+// has already been unregistered.
+func (h Handle) Unregister() {
+	hookMu.Lock()
+	defer hookMu.Unlock()
+	regs := hookMap[h.kind]
+	for i, r := range regs {
+		if r.id == h.id {
+			hookMap[h.kind] = append(regs[:i], regs[i+1:]...)
+			break
+		}
+	}
+}
+
+type registration struct {
+	id       uint64
+	priority int
+	callback Callback
+}
+
 var (
-	hookMap = make(map[string][]func(interface{}))
-	hookMu  = sync.Mutex{}
+	hookMap = make(map[Kind][]registration)
+	hookMu  sync.Mutex
+	nextID  uint64
 	enabled = false
 )
 
@@ -37,29 +128,60 @@ func Enable() {
 	enabled = true
 }
 
-// Run any hooks
-func Run(kind string, data interface{}) {
+// Run executes every callback attached to kind, in priority order (lowest priority number
+// first), passing event along the chain. It does nothing and returns event unchanged unless
+// Enable has been called. For KindPrePersistEvent only: if a callback returns Replace, subsequent
+// callbacks and the caller see the replacement event, and if a callback returns Reject, Run stops
+// immediately and returns the rejection error without invoking any remaining callbacks; callers
+// such as the roomserver input pipeline must treat a non-nil error as "do not persist this event".
+// For every other kind the returned HookAction is ignored; only a non-nil error stops the chain.
+func Run(kind Kind, event *gomatrixserverlib.HeaderedEvent) (*gomatrixserverlib.HeaderedEvent, error) {
 	if !enabled {
-		return
+		return event, nil
 	}
-	cbs := callbacks(kind)
-	for _, cb := range cbs {
-		cb(data)
+	for _, reg := range callbacks(kind) {
+		action, err := reg.callback(event)
+		if err != nil {
+			return event, err
+		}
+		// Only KindPrePersistEvent callbacks may replace or reject the event; every other kind
+		// fires after the event is already durably persisted (or, for KindEDU, doesn't persist at
+		// all), so their HookAction is ignored.
+		if kind != KindPrePersistEvent {
+			continue
+		}
+		switch action.Kind {
+		case ActionReplace:
+			event = action.NewEvent
+		case ActionReject:
+			return event, action.RejectError
+		}
 	}
+	publish(kind, event)
+	return event, nil
 }
 
-// Attach a hook
-func Attach(kind string, callback func(interface{})) {
-	if !enabled {
-		return
-	}
+// Attach registers callback to run whenever kind fires. priority determines the order callbacks
+// for the same kind run in: lower values run first. This matters when multiple MSCs attach to
+// the same kind and need a deterministic order, e.g. one MSC rewriting an event before another
+// inspects it. Attach returns a Handle which can be used to unregister the callback later.
+func Attach(kind Kind, priority int, callback Callback) Handle {
 	hookMu.Lock()
 	defer hookMu.Unlock()
-	hookMap[kind] = append(hookMap[kind], callback)
+	nextID++
+	id := nextID
+	regs := append(hookMap[kind], registration{id: id, priority: priority, callback: callback})
+	sort.SliceStable(regs, func(i, j int) bool {
+		return regs[i].priority < regs[j].priority
+	})
+	hookMap[kind] = regs
+	return Handle{kind: kind, id: id, priority: priority}
 }
 
-func callbacks(kind string) []func(interface{}) {
+func callbacks(kind Kind) []registration {
 	hookMu.Lock()
 	defer hookMu.Unlock()
-	return hookMap[kind]
-}
\ No newline at end of file
+	regs := make([]registration, len(hookMap[kind]))
+	copy(regs, hookMap[kind])
+	return regs
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// subjectPrefix is prepended to a Kind to form the NATS subject a hook invocation is published
+// on, e.g. KindPostPersistEvent becomes "hook.post_persist_event".
+const subjectPrefix = "hook."
+
+// wireMessage is the payload published to the hook subject. It deliberately carries only the
+// event: Run's HookAction is not transported, since a remote subscriber can only observe the
+// event, not veto or replace it on behalf of the process that ran the local pipeline.
+type wireMessage struct {
+	Event *gomatrixserverlib.HeaderedEvent `json:"event"`
+}
+
+// Publisher is the subset of a NATS JetStream context that EnablePublish needs. It is satisfied
+// by a nats.JetStreamContext, so callers can pass the one Dendrite's setup package has already
+// created for the roomserver output stream.
+type Publisher interface {
+	PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error)
+}
+
+var publisher Publisher
+
+// EnablePublish wires the hook pipeline up to transport: every subsequent Run call additionally
+// publishes the event onto js under subject "hook.<kind>". This lets MSC subsystems that live in
+// a separate polylith process subscribe via Serve instead of being linked into the same binary
+// as the roomserver.
+func EnablePublish(js Publisher) {
+	publisher = js
+}
+
+func publish(kind Kind, event *gomatrixserverlib.HeaderedEvent) {
+	if publisher == nil {
+		return
+	}
+	body, err := json.Marshal(wireMessage{Event: event})
+	if err != nil {
+		logrus.WithError(err).WithField("kind", kind).Error("hooks: failed to marshal hook message")
+		return
+	}
+	msg := nats.NewMsg(subjectPrefix + string(kind))
+	msg.Data = body
+	if _, err = publisher.PublishMsg(msg); err != nil {
+		logrus.WithError(err).WithField("kind", kind).Error("hooks: failed to publish hook message")
+	}
+}
+
+// Subscriber is the subset of a NATS JetStream context that Serve needs to subscribe to hook
+// subjects. It is satisfied by a nats.JetStreamContext.
+type Subscriber interface {
+	Subscribe(subj string, cb nats.MsgHandler, opts ...nats.SubOpt) (*nats.Subscription, error)
+}
+
+// Serve subscribes to the hook subjects for each of kinds and re-invokes any callbacks attached
+// locally via Attach whenever a message arrives, decoding the wire payload back into a
+// *gomatrixserverlib.HeaderedEvent. This is how a polylith MSC process, e.g. msc2836's thread
+// indexer running on its own, observes events produced by a roomserver running elsewhere: it
+// never needs to be linked into the roomserver binary, only to Serve the kinds it cares about.
+//
+// Serve blocks until ctx is cancelled, unsubscribing before it returns.
+func Serve(ctx context.Context, js Subscriber, kinds ...Kind) error {
+	subs := make([]*nats.Subscription, 0, len(kinds))
+	defer func() {
+		for _, sub := range subs {
+			_ = sub.Unsubscribe()
+		}
+	}()
+	for _, kind := range kinds {
+		kind := kind
+		sub, err := js.Subscribe(subjectPrefix+string(kind), func(msg *nats.Msg) {
+			var wire wireMessage
+			if err := json.Unmarshal(msg.Data, &wire); err != nil {
+				logrus.WithError(err).WithField("kind", kind).Error("hooks: failed to unmarshal hook message")
+				return
+			}
+			if _, err := Run(kind, wire.Event); err != nil {
+				logrus.WithError(err).WithField("kind", kind).Warn("hooks: local callback rejected remotely-delivered event")
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("hooks: failed to subscribe to %q: %w", kind, err)
+		}
+		subs = append(subs, sub)
+	}
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package msc2836 implements https://github.com/matrix-org/matrix-doc/pull/2836, which lets
+// clients walk a tree of related events (e.g. threads) via POST /event_relationships.
+package msc2836
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/hooks"
+	"github.com/matrix-org/dendrite/internal/setup"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMaxFederationHops bounds how many times a single /event_relationships request will
+// cross onto a remote server while walking a relationship graph, used when
+// base.Cfg.MSCs.MaxFederationHops is unset. It exists so a pathological or malicious thread
+// cannot make the walker bounce between servers indefinitely.
+const defaultMaxFederationHops = 3
+
+// FederationSender is the subset of the federation sender's internal API msc2836 needs to walk
+// a relationship graph that crosses onto a server other than our own. It mirrors the querying
+// server's normal signed federation request path, so a response is authenticated the same way
+// any other federation traffic is.
+type FederationSender interface {
+	PerformMSC2836EventRelationships(ctx context.Context, request *PerformMSC2836EventRelationshipsRequest, response *PerformMSC2836EventRelationshipsResponse) error
+}
+
+// RelationDirection tells the federation peer which side of EventID the caller is walking
+// towards, since they are served by different federation endpoints on the remote server.
+type RelationDirection string
+
+const (
+	// DirectionParent asks for the event EventID itself, which the caller reached as the parent
+	// of an event it already has, answered from the remote's own /relationships (room version
+	// relations) endpoint.
+	DirectionParent RelationDirection = "parent"
+	// DirectionChildren asks for the events that reference EventID, answered from the remote's
+	// own /event_relationships (MSC2836) endpoint.
+	DirectionChildren RelationDirection = "children"
+)
+
+// PerformMSC2836EventRelationshipsRequest asks ServerName for EventID itself (DirectionParent) or
+// for the events that reference it (DirectionChildren).
+// The remote server answers from its own /event_relationships (MSC2836, DirectionChildren) or
+// /relationships (room version relations, DirectionParent) endpoint accordingly.
+type PerformMSC2836EventRelationshipsRequest struct {
+	ServerName  gomatrixserverlib.ServerName
+	RoomID      string
+	EventID     string
+	Direction   RelationDirection
+	RoomVersion gomatrixserverlib.RoomVersion
+}
+
+// PerformMSC2836EventRelationshipsResponse carries the events the remote server returned. Events
+// are expected to already carry valid signatures for RoomVersion; the caller re-verifies them
+// before trusting or persisting anything.
+type PerformMSC2836EventRelationshipsResponse struct {
+	Events []*gomatrixserverlib.HeaderedEvent
+}
+
+// EventRelationshipRequest is the body of POST /event_relationships.
+type EventRelationshipRequest struct {
+	EventID         string `json:"event_id"`
+	RoomID          string `json:"room_id,omitempty"`
+	IncludeParent   *bool  `json:"include_parent,omitempty"`
+	IncludeChildren *bool  `json:"include_children,omitempty"`
+	RecentFirst     *bool  `json:"recent_first,omitempty"`
+	Limit           int    `json:"limit,omitempty"`
+}
+
+func (r *EventRelationshipRequest) limit() int {
+	if r.Limit <= 0 || r.Limit > 100 {
+		return 50
+	}
+	return r.Limit
+}
+
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
+
+// EventRelationshipResponse is the body of a successful POST /event_relationships response.
+type EventRelationshipResponse struct {
+	Events  []*gomatrixserverlib.HeaderedEvent `json:"events"`
+	Limited bool                               `json:"limited"`
+}
+
+// Enable wires msc2836 into base: it opens the msc2836 database, attaches a hook which records
+// every event's relation as it is persisted, and registers POST /event_relationships on
+// base.PublicClientAPIMux. fsAPI is used to cross onto a remote server when the relationship
+// graph being walked references an event this server has never seen; keyRing verifies the
+// signature of every event fetched that way before it is trusted or persisted.
+func Enable(base *setup.BaseDendrite, rsAPI roomserver.RoomserverInternalAPI, userAPI userapi.UserInternalAPI, fsAPI FederationSender, keyRing gomatrixserverlib.JSONVerifier) error {
+	db, err := NewDatabase(&base.Cfg.MSCs.Database)
+	if err != nil {
+		return err
+	}
+	hooks.Attach(hooks.KindPostPersistEvent, 0, func(ev *gomatrixserverlib.HeaderedEvent) (hooks.HookAction, error) {
+		if err := db.StoreRelation(context.Background(), ev); err != nil {
+			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("msc2836: failed to store relation")
+		}
+		return hooks.Continue(), nil
+	})
+
+	maxHops := base.Cfg.MSCs.MaxFederationHops
+	if maxHops <= 0 {
+		maxHops = defaultMaxFederationHops
+	}
+	rp := &requestPool{
+		db:         db,
+		rsAPI:      rsAPI,
+		userAPI:    userAPI,
+		fsAPI:      fsAPI,
+		keyRing:    keyRing,
+		serverName: base.Cfg.Global.ServerName,
+		maxHops:    maxHops,
+	}
+	base.PublicClientAPIMux.Handle("/unstable/event_relationships", http.HandlerFunc(rp.handleEventRelationships)).Methods(http.MethodPost, http.MethodOptions)
+	return nil
+}
+
+type requestPool struct {
+	db         *Database
+	rsAPI      roomserver.RoomserverInternalAPI
+	userAPI    userapi.UserInternalAPI
+	fsAPI      FederationSender
+	keyRing    gomatrixserverlib.JSONVerifier
+	serverName gomatrixserverlib.ServerName
+	maxHops    int
+}
+
+func (rp *requestPool) handleEventRelationships(w http.ResponseWriter, httpReq *http.Request) {
+	device, ok := rp.authenticate(httpReq)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, map[string]string{"errcode": "M_FORBIDDEN", "error": "invalid access token"})
+		return
+	}
+	var req EventRelationshipRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"errcode": "M_NOT_JSON", "error": err.Error()})
+		return
+	}
+
+	wk := &walker{
+		ctx:    httpReq.Context(),
+		rp:     rp,
+		userID: device.UserID,
+	}
+	res, err := wk.walk(&req)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"errcode": "M_FORBIDDEN", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// authenticate performs the same Authorization: Bearer <token> check every other client API
+// endpoint uses, without pulling in the full httputil auth wrapper so the msc2836 handler stays
+// a plain http.HandlerFunc that is easy to exercise in tests.
+func (rp *requestPool) authenticate(httpReq *http.Request) (*userapi.Device, bool) {
+	token := strings.TrimPrefix(httpReq.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return nil, false
+	}
+	var res userapi.QueryAccessTokenResponse
+	if err := rp.userAPI.QueryAccessToken(httpReq.Context(), &userapi.QueryAccessTokenRequest{AccessToken: token}, &res); err != nil || res.Err != nil || res.Device == nil {
+		return nil, false
+	}
+	return res.Device, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -178,7 +178,7 @@ func TestMSC2836(t *testing.T) {
 			eventH.EventID(): eventH,
 		},
 	}
-	router := injectEvents(t, nopUserAPI, nopRsAPI, []*gomatrixserverlib.HeaderedEvent{
+	router := injectEvents(t, nopUserAPI, nopRsAPI, &testFederationSender{}, &testKeyRing{}, []*gomatrixserverlib.HeaderedEvent{
 		eventA, eventB, eventC, eventD, eventE, eventF, eventG, eventH,
 	})
 	cancel := runServer(t, router)
@@ -206,6 +206,140 @@ func TestMSC2836(t *testing.T) {
 	})
 }
 
+// TestMSC2836FederatedThreadWalk checks that walking include_parent across an event whose parent
+// was never seen locally results in a federated request to the child event's origin server, and
+// that the fetched parent is served back to the client.
+func TestMSC2836FederatedThreadWalk(t *testing.T) {
+	alice := "@alice:localhost"
+	remoteRoomID := "!remote:remote.example.com"
+	remoteParent := mustCreateEvent(t, gomatrixserverlib.RoomVersionV6, fledglingEvent{
+		RoomID: remoteRoomID,
+		Sender: "@bob:remote.example.com",
+		Type:   "m.room.message",
+		Content: map[string]interface{}{
+			"body": "[remote] root of the thread",
+		},
+	})
+	localChild := mustCreateEvent(t, gomatrixserverlib.RoomVersionV6, fledglingEvent{
+		RoomID: remoteRoomID,
+		Sender: "@bob:remote.example.com",
+		Type:   "m.room.message",
+		Content: map[string]interface{}{
+			"body": "[local] a reply the local server does have",
+			"m.relationship": map[string]string{
+				"rel_type": "m.reference",
+				"event_id": remoteParent.EventID(),
+			},
+		},
+	})
+
+	nopUserAPI := &testUserAPI{accessTokens: map[string]userapi.Device{
+		"alice": {AccessToken: "alice", DisplayName: "Alice", UserID: alice},
+	}}
+	nopRsAPI := &testRoomserverAPI{
+		userToJoinedRooms: map[string][]string{alice: {remoteRoomID}},
+		events:            map[string]*gomatrixserverlib.HeaderedEvent{localChild.EventID(): localChild},
+	}
+	fedStub := &testFederationSender{events: map[string]*gomatrixserverlib.HeaderedEvent{
+		remoteParent.EventID(): remoteParent,
+	}}
+
+	router := injectEvents(t, nopUserAPI, nopRsAPI, fedStub, &testKeyRing{}, []*gomatrixserverlib.HeaderedEvent{localChild})
+	cancel := runServer(t, router)
+	defer cancel()
+
+	res := postRelationships(t, "alice", &msc2836.EventRelationshipRequest{
+		EventID:       localChild.EventID(),
+		IncludeParent: &constTrue,
+		Limit:         2,
+	})
+	if res.StatusCode != 200 {
+		out, _ := nethttputil.DumpResponse(res, true)
+		t.Fatalf("failed to perform request: %s", string(out))
+	}
+	var body msc2836.EventRelationshipResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(body.Events) != 2 {
+		t.Fatalf("want 2 events (child + federated parent), got %d", len(body.Events))
+	}
+	foundParent := false
+	for _, ev := range body.Events {
+		if ev.EventID() == remoteParent.EventID() {
+			foundParent = true
+		}
+	}
+	if !foundParent {
+		t.Fatalf("response did not include the federated parent event %s", remoteParent.EventID())
+	}
+}
+
+// TestMSC2836FederatedThreadWalkRejectsInvalidSignature checks that an event fetched over
+// federation whose signature fails verification is dropped rather than served to the client,
+// even though the federation sender otherwise answered the request successfully.
+func TestMSC2836FederatedThreadWalkRejectsInvalidSignature(t *testing.T) {
+	alice := "@alice:localhost"
+	remoteRoomID := "!remote2:remote.example.com"
+	remoteParent := mustCreateEvent(t, gomatrixserverlib.RoomVersionV6, fledglingEvent{
+		RoomID: remoteRoomID,
+		Sender: "@bob:remote.example.com",
+		Type:   "m.room.message",
+		Content: map[string]interface{}{
+			"body": "[remote] root of the thread",
+		},
+	})
+	localChild := mustCreateEvent(t, gomatrixserverlib.RoomVersionV6, fledglingEvent{
+		RoomID: remoteRoomID,
+		Sender: "@bob:remote.example.com",
+		Type:   "m.room.message",
+		Content: map[string]interface{}{
+			"body": "[local] a reply the local server does have",
+			"m.relationship": map[string]string{
+				"rel_type": "m.reference",
+				"event_id": remoteParent.EventID(),
+			},
+		},
+	})
+
+	nopUserAPI := &testUserAPI{accessTokens: map[string]userapi.Device{
+		"alice": {AccessToken: "alice", DisplayName: "Alice", UserID: alice},
+	}}
+	nopRsAPI := &testRoomserverAPI{
+		userToJoinedRooms: map[string][]string{alice: {remoteRoomID}},
+		events:            map[string]*gomatrixserverlib.HeaderedEvent{localChild.EventID(): localChild},
+	}
+	fedStub := &testFederationSender{events: map[string]*gomatrixserverlib.HeaderedEvent{
+		remoteParent.EventID(): remoteParent,
+	}}
+
+	router := injectEvents(t, nopUserAPI, nopRsAPI, fedStub, &testKeyRing{rejectAll: true}, []*gomatrixserverlib.HeaderedEvent{localChild})
+	cancel := runServer(t, router)
+	defer cancel()
+
+	res := postRelationships(t, "alice", &msc2836.EventRelationshipRequest{
+		EventID:       localChild.EventID(),
+		IncludeParent: &constTrue,
+		Limit:         2,
+	})
+	if res.StatusCode != 200 {
+		out, _ := nethttputil.DumpResponse(res, true)
+		t.Fatalf("failed to perform request: %s", string(out))
+	}
+	var body msc2836.EventRelationshipResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(body.Events) != 1 {
+		t.Fatalf("want 1 event (child only, parent's signature was rejected), got %d", len(body.Events))
+	}
+	for _, ev := range body.Events {
+		if ev.EventID() == remoteParent.EventID() {
+			t.Fatalf("response included %s despite its signature failing verification", remoteParent.EventID())
+		}
+	}
+}
+
 func runServer(t *testing.T, router *mux.Router) func() {
 	t.Helper()
 	externalServ := &http.Server{
@@ -328,24 +462,65 @@ func (r *testRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *roo
 	return nil
 }
 
-func injectEvents(t *testing.T, userAPI userapi.UserInternalAPI, rsAPI roomserver.RoomserverInternalAPI, events []*gomatrixserverlib.HeaderedEvent) *mux.Router {
+// testFederationSender is an in-process stub standing in for a second homeserver: it answers
+// PerformMSC2836EventRelationships from its own local event map instead of making a real network
+// request, the same way testRoomserverAPI/testUserAPI stand in for their respective components.
+type testFederationSender struct {
+	events map[string]*gomatrixserverlib.HeaderedEvent
+}
+
+func (f *testFederationSender) PerformMSC2836EventRelationships(ctx context.Context, req *msc2836.PerformMSC2836EventRelationshipsRequest, res *msc2836.PerformMSC2836EventRelationshipsResponse) error {
+	ev, ok := f.events[req.EventID]
+	if !ok {
+		return fmt.Errorf("testFederationSender: unknown event %s", req.EventID)
+	}
+	res.Events = []*gomatrixserverlib.HeaderedEvent{ev}
+	return nil
+}
+
+// testKeyRing stands in for the real federation KeyRing. By default it treats every event as
+// validly signed so most of these tests can focus on msc2836's own walking logic rather than on
+// signing fixtures that would actually satisfy gomatrixserverlib's verifier for an event claiming
+// to originate from a server other than the one mustCreateEvent signs with; set rejectAll to
+// exercise the path where verification fails instead.
+type testKeyRing struct {
+	rejectAll bool
+}
+
+func (k *testKeyRing) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	if k.rejectAll {
+		for i := range results {
+			results[i].Error = fmt.Errorf("testKeyRing: signature rejected")
+		}
+	}
+	return results, nil
+}
+
+func injectEvents(t *testing.T, userAPI userapi.UserInternalAPI, rsAPI roomserver.RoomserverInternalAPI, fsAPI msc2836.FederationSender, keyRing gomatrixserverlib.JSONVerifier, events []*gomatrixserverlib.HeaderedEvent) *mux.Router {
 	t.Helper()
 	cfg := &config.Dendrite{}
 	cfg.Defaults()
 	cfg.Global.ServerName = "localhost"
-	cfg.MSCs.Database.ConnectionString = "file:msc2836_test.db"
+	// Each test gets its own on-disk database: event IDs are content-hashed and deterministic, so
+	// a path shared across test runs (or across test functions) would let a later run silently
+	// satisfy a lookup from a previous run's leftover rows instead of exercising the fetch path
+	// the test is meant to cover.
+	cfg.MSCs.Database.ConnectionString = config.DataSource(fmt.Sprintf("file:%s/msc2836_test.db", t.TempDir()))
 	cfg.MSCs.MSCs = []string{"msc2836"}
 	base := &setup.BaseDendrite{
 		Cfg:                cfg,
 		PublicClientAPIMux: mux.NewRouter().PathPrefix(httputil.PublicClientPathPrefix).Subrouter(),
 	}
 
-	err := msc2836.Enable(base, rsAPI, userAPI)
+	err := msc2836.Enable(base, rsAPI, userAPI, fsAPI, keyRing)
 	if err != nil {
 		t.Fatalf("failed to enable MSC2836: %s", err)
 	}
 	for _, ev := range events {
-		hooks.Run(hooks.KindNewEvent, ev)
+		if _, err := hooks.Run(hooks.KindPostPersistEvent, ev); err != nil {
+			t.Fatalf("injectEvents: hooks.Run returned an error: %s", err)
+		}
 	}
 	return base.PublicClientAPIMux
 }
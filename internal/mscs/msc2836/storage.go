@@ -0,0 +1,143 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msc2836
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS msc2836_events (
+	event_id TEXT PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	parent_event_id TEXT NOT NULL DEFAULT '',
+	rel_type TEXT NOT NULL DEFAULT '',
+	event_json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS msc2836_events_parent_idx ON msc2836_events(parent_event_id);
+`
+
+// Database persists the events msc2836 has seen (locally produced or fetched over federation)
+// along with the m.relationship edges between them, so a thread can be walked without re-asking
+// the roomserver or a remote homeserver for events it already knows about.
+type Database struct {
+	db         *sql.DB
+	writeMu    sync.Mutex
+	insertStmt *sql.Stmt
+}
+
+// NewDatabase opens (and if necessary creates) the msc2836 database described by dbOpts.
+func NewDatabase(dbOpts *config.DatabaseOptions) (*Database, error) {
+	db, err := sqlutil.Open(dbOpts)
+	if err != nil {
+		return nil, fmt.Errorf("msc2836: failed to open database: %w", err)
+	}
+	if _, err = db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("msc2836: failed to create schema: %w", err)
+	}
+	insertStmt, err := db.Prepare(
+		`INSERT INTO msc2836_events(event_id, room_id, parent_event_id, rel_type, event_json)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (event_id) DO NOTHING`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("msc2836: failed to prepare insert statement: %w", err)
+	}
+	return &Database{db: db, insertStmt: insertStmt}, nil
+}
+
+// StoreRelation records ev, along with the parent event ID and rel_type taken from its
+// m.relationship content, if any. It is safe to call with an event that has no relationship;
+// it is simply stored with an empty parent so it can be looked up by ID later.
+func (d *Database) StoreRelation(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) error {
+	parentEventID, relType := parentOf(ev)
+	eventJSON, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("msc2836: failed to marshal event: %w", err)
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, err = d.insertStmt.ExecContext(ctx, ev.EventID(), ev.RoomID(), parentEventID, relType, string(eventJSON))
+	return err
+}
+
+// ChildrenForParent returns every event directly related to parentEventID, optionally filtered
+// to a specific relType (an empty relType matches any relation).
+func (d *Database) ChildrenForParent(ctx context.Context, parentEventID, relType string) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	query := `SELECT event_json FROM msc2836_events WHERE parent_event_id = $1`
+	args := []interface{}{parentEventID}
+	if relType != "" {
+		query += ` AND rel_type = $2`
+		args = append(args, relType)
+	}
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	return scanEvents(rows)
+}
+
+// Event returns the event previously stored under eventID, or nil if msc2836 has never seen it.
+func (d *Database) Event(ctx context.Context, eventID string) (*gomatrixserverlib.HeaderedEvent, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT event_json FROM msc2836_events WHERE event_id = $1`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	events, err := scanEvents(rows)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+func scanEvents(rows *sql.Rows) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	for rows.Next() {
+		var eventJSON string
+		if err := rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		var ev gomatrixserverlib.HeaderedEvent
+		if err := json.Unmarshal([]byte(eventJSON), &ev); err != nil {
+			return nil, err
+		}
+		events = append(events, &ev)
+	}
+	return events, rows.Err()
+}
+
+// parentOf extracts the parent event ID and rel_type from ev's m.relationship content, if any.
+func parentOf(ev *gomatrixserverlib.HeaderedEvent) (parentEventID, relType string) {
+	var content struct {
+		Relationship *struct {
+			EventID string `json:"event_id"`
+			RelType string `json:"rel_type"`
+		} `json:"m.relationship"`
+	}
+	if err := json.Unmarshal(ev.Content(), &content); err != nil || content.Relationship == nil {
+		return "", ""
+	}
+	return content.Relationship.EventID, content.Relationship.RelType
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msc2836
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// walker answers a single POST /event_relationships request. It is single-use: create one per
+// request, call walk once. hopsUsed counts how many federation round-trips have been spent
+// resolving this request so far, across every branch of the walk, and is checked against
+// rp.maxHops before crossing onto federation again.
+type walker struct {
+	ctx      context.Context
+	rp       *requestPool
+	userID   string
+	hopsUsed int
+}
+
+// walk resolves req.EventID from the local msc2836 database or the roomserver (it is never
+// fetched over federation, since no origin server is known for it) and, depending on which of
+// IncludeParent/IncludeChildren were requested, walks up to the event's ancestors and/or down
+// through its children, crossing onto federation for any of those the local server has never
+// seen, until res.Events reaches req.limit() or the federation hop budget is exhausted.
+func (w *walker) walk(req *EventRelationshipRequest) (*EventRelationshipResponse, error) {
+	root, err := w.fetchEvent(req.EventID, "")
+	if err != nil {
+		return nil, fmt.Errorf("event %s: %w", req.EventID, err)
+	}
+	if !w.userCanSee(root) {
+		return nil, fmt.Errorf("event %s not visible to %s", req.EventID, w.userID)
+	}
+
+	res := &EventRelationshipResponse{Events: []*gomatrixserverlib.HeaderedEvent{root}}
+	limit := req.limit()
+	originHint := originOf(root)
+
+	if boolValue(req.IncludeParent) {
+		w.walkParents(root, originHint, res, limit)
+	}
+
+	if boolValue(req.IncludeChildren) {
+		w.walkChildren(root.EventID(), originHint, res, limit)
+	}
+
+	return res, nil
+}
+
+// walkParents climbs from ev to its parent, grandparent and so on, appending each ancestor the
+// requester can see to res.Events, until there is no further parent, res.Events reaches limit,
+// or the federation hop budget runs out partway up a thread that isn't fully stored locally.
+func (w *walker) walkParents(ev *gomatrixserverlib.HeaderedEvent, originHint gomatrixserverlib.ServerName, res *EventRelationshipResponse, limit int) {
+	if len(res.Events) >= limit {
+		res.Limited = true
+		return
+	}
+	parentID, _ := parentOf(ev)
+	if parentID == "" {
+		return
+	}
+	parent, err := w.fetchEvent(parentID, originHint)
+	if err != nil {
+		logrus.WithError(err).WithField("event_id", parentID).Warn("msc2836: failed to fetch parent")
+		return
+	}
+	if !w.userCanSee(parent) {
+		return
+	}
+	res.Events = append(res.Events, parent)
+	w.walkParents(parent, originOf(parent), res, limit)
+}
+
+// walkChildren fetches the events directly related to parentEventID and recurses into each of
+// their own children in turn, so a whole subtree is walked rather than just its first level,
+// until res.Events reaches limit or the federation hop budget runs out.
+func (w *walker) walkChildren(parentEventID string, originHint gomatrixserverlib.ServerName, res *EventRelationshipResponse, limit int) {
+	if len(res.Events) >= limit {
+		res.Limited = true
+		return
+	}
+	children, err := w.fetchChildren(parentEventID, originHint)
+	if err != nil {
+		logrus.WithError(err).WithField("event_id", parentEventID).Warn("msc2836: failed to fetch children")
+		return
+	}
+	for _, child := range children {
+		if len(res.Events) >= limit {
+			res.Limited = true
+			return
+		}
+		if !w.userCanSee(child) {
+			continue
+		}
+		res.Events = append(res.Events, child)
+		w.walkChildren(child.EventID(), originOf(child), res, limit)
+	}
+}
+
+// fetchEvent returns eventID, consulting the local msc2836 database and then the roomserver
+// before, as a last resort, asking originHint over federation.
+func (w *walker) fetchEvent(eventID string, originHint gomatrixserverlib.ServerName) (*gomatrixserverlib.HeaderedEvent, error) {
+	if ev, err := w.rp.db.Event(w.ctx, eventID); err == nil && ev != nil {
+		return ev, nil
+	}
+
+	var qryRes roomserver.QueryEventsByIDResponse
+	err := w.rp.rsAPI.QueryEventsByID(w.ctx, &roomserver.QueryEventsByIDRequest{EventIDs: []string{eventID}}, &qryRes)
+	if err == nil && len(qryRes.Events) > 0 {
+		return &qryRes.Events[0], nil
+	}
+
+	if !w.canCrossFederation(originHint) {
+		return nil, fmt.Errorf("unknown event %s", eventID)
+	}
+	return w.fetchEventOverFederation(eventID, originHint)
+}
+
+// fetchEventOverFederation resolves one specific, already-known event ID: an ancestor reached by
+// walkParents. That climbs towards the root of a thread rather than enumerating children, so it
+// asks for DirectionParent.
+func (w *walker) fetchEventOverFederation(eventID string, origin gomatrixserverlib.ServerName) (*gomatrixserverlib.HeaderedEvent, error) {
+	w.hopsUsed++
+	var fedRes PerformMSC2836EventRelationshipsResponse
+	err := w.rp.fsAPI.PerformMSC2836EventRelationships(w.ctx, &PerformMSC2836EventRelationshipsRequest{
+		ServerName: origin,
+		EventID:    eventID,
+		Direction:  DirectionParent,
+	}, &fedRes)
+	if err != nil {
+		return nil, fmt.Errorf("federation request to %s for %s failed: %w", origin, eventID, err)
+	}
+	var found *gomatrixserverlib.HeaderedEvent
+	for _, ev := range fedRes.Events {
+		if err := w.verifyFederationEvent(ev); err != nil {
+			logrus.WithError(err).WithField("event_id", ev.EventID()).Warn("msc2836: dropping event with invalid federation signature")
+			continue
+		}
+		if err := w.rp.db.StoreRelation(w.ctx, ev); err != nil {
+			logrus.WithError(err).WithField("event_id", ev.EventID()).Warn("msc2836: failed to persist event fetched over federation")
+		}
+		if ev.EventID() == eventID {
+			found = ev
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("server %s did not return a validly-signed copy of %s", origin, eventID)
+	}
+	return found, nil
+}
+
+// fetchChildren returns the events directly related to parentEventID. Only when the local server
+// has none of them stored does it fetch them over federation via originHint; if some are stored
+// locally, those alone are returned.
+func (w *walker) fetchChildren(parentEventID string, originHint gomatrixserverlib.ServerName) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	children, err := w.rp.db.ChildrenForParent(w.ctx, parentEventID, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(children) > 0 || !w.canCrossFederation(originHint) {
+		return children, nil
+	}
+
+	w.hopsUsed++
+	var fedRes PerformMSC2836EventRelationshipsResponse
+	err = w.rp.fsAPI.PerformMSC2836EventRelationships(w.ctx, &PerformMSC2836EventRelationshipsRequest{
+		ServerName: originHint,
+		EventID:    parentEventID,
+		Direction:  DirectionChildren,
+	}, &fedRes)
+	if err != nil {
+		return nil, fmt.Errorf("federation request to %s for children of %s failed: %w", originHint, parentEventID, err)
+	}
+	for _, ev := range fedRes.Events {
+		if err := w.verifyFederationEvent(ev); err != nil {
+			logrus.WithError(err).WithField("event_id", ev.EventID()).Warn("msc2836: dropping event with invalid federation signature")
+			continue
+		}
+		if err := w.rp.db.StoreRelation(w.ctx, ev); err != nil {
+			logrus.WithError(err).WithField("event_id", ev.EventID()).Warn("msc2836: failed to persist event fetched over federation")
+		}
+		id, _ := parentOf(ev)
+		if id == parentEventID {
+			children = append(children, ev)
+		}
+	}
+	return children, nil
+}
+
+// verifyFederationEvent checks ev's signature and content hash against the key of the server
+// that sent it, so a compromised or malicious federation peer cannot inject fabricated events
+// into the local msc2836 database or a client's view of a thread.
+func (w *walker) verifyFederationEvent(ev *gomatrixserverlib.HeaderedEvent) error {
+	if w.rp.keyRing == nil {
+		return fmt.Errorf("no key ring configured to verify federation events")
+	}
+	return gomatrixserverlib.VerifyAllEventSignatures(w.ctx, []*gomatrixserverlib.HeaderedEvent{ev}, w.rp.keyRing)
+}
+
+// userCanSee reports whether w.userID is allowed to see ev, i.e. is currently joined to
+// ev.RoomID(). MSC2836 intentionally does not implement full history-visibility semantics; like
+// the rest of this package it only supports the common case of walking a thread in a room the
+// requester is a member of.
+func (w *walker) userCanSee(ev *gomatrixserverlib.HeaderedEvent) bool {
+	if ev == nil {
+		return false
+	}
+	var res roomserver.QueryMembershipForUserResponse
+	err := w.rp.rsAPI.QueryMembershipForUser(w.ctx, &roomserver.QueryMembershipForUserRequest{
+		RoomID: ev.RoomID(),
+		UserID: w.userID,
+	}, &res)
+	return err == nil && res.IsInRoom
+}
+
+// canCrossFederation reports whether it is worth asking originHint for an event the local
+// server doesn't have: there must be a hint at all, it must not be our own server (we've already
+// checked our own roomserver), a federation sender must be configured, and this request must not
+// have already spent its federation hop budget crossing onto other servers.
+func (w *walker) canCrossFederation(originHint gomatrixserverlib.ServerName) bool {
+	return originHint != "" && originHint != w.rp.serverName && w.rp.fsAPI != nil && w.hopsUsed < w.rp.maxHops
+}
+
+// originOf returns the server name embedded in ev's sender, used as the federation destination
+// to ask about ev's parent or children if they are not already known locally.
+func originOf(ev *gomatrixserverlib.HeaderedEvent) gomatrixserverlib.ServerName {
+	idx := strings.IndexByte(ev.Sender(), ':')
+	if idx == -1 {
+		return ""
+	}
+	return gomatrixserverlib.ServerName(ev.Sender()[idx+1:])
+}
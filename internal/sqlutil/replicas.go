@@ -0,0 +1,218 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// replicaHealthCheckInterval is how often an unhealthy replica is re-pinged to see if it has
+// recovered. It isn't configurable: a component that wants tighter control over staleness should
+// set DatabaseOptions.ReplicaOverride to pin itself to a specific replica instead.
+const replicaHealthCheckInterval = 30 * time.Second
+
+type replica struct {
+	dsn      string
+	db       *sql.DB
+	healthy  int32 // atomic bool: 1 = healthy, 0 = unhealthy
+	inFlight int64 // atomic
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *replica) markUnhealthy(err error) {
+	if atomic.CompareAndSwapInt32(&r.healthy, 1, 0) {
+		logrus.WithError(err).WithField("replica", r.dsn).Warn("sqlutil: marking read replica unhealthy")
+	}
+}
+
+func (r *replica) checkHealth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := r.db.PingContext(ctx); err != nil {
+		r.markUnhealthy(err)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&r.healthy, 0, 1) {
+		logrus.WithField("replica", r.dsn).Info("sqlutil: read replica is healthy again")
+	}
+}
+
+// replicaPool is the set of read replicas configured for a single primary *sql.DB.
+type replicaPool struct {
+	replicas     []*replica
+	stop         chan struct{}
+	preferredDSN string
+}
+
+// choose picks a healthy replica to send a read to, preferring preferredDSN if it names a
+// currently-healthy replica, and otherwise picking whichever healthy replica currently has the
+// fewest in-flight queries.
+func (p *replicaPool) choose() *replica {
+	if p.preferredDSN != "" {
+		for _, r := range p.replicas {
+			if r.dsn == p.preferredDSN && r.isHealthy() {
+				return r
+			}
+		}
+	}
+	var best *replica
+	for _, r := range p.replicas {
+		if !r.isHealthy() {
+			continue
+		}
+		if best == nil || atomic.LoadInt64(&r.inFlight) < atomic.LoadInt64(&best.inFlight) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (p *replicaPool) startHealthChecks() {
+	go func() {
+		ticker := time.NewTicker(replicaHealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				for _, r := range p.replicas {
+					if !r.isHealthy() {
+						r.checkHealth(context.Background())
+					}
+				}
+			}
+		}
+	}()
+}
+
+// close stops the background health-check goroutine and closes every replica's *sql.DB. It is
+// called from CloseWithWriter via cleanupDB, once for the lifetime of the pool.
+func (p *replicaPool) close() {
+	close(p.stop)
+	for _, r := range p.replicas {
+		if err := r.db.Close(); err != nil {
+			logrus.WithError(err).WithField("replica", r.dsn).Warn("sqlutil: failed to close read replica")
+		}
+	}
+}
+
+// replicaPools maps a primary *sql.DB to the pool of read replicas opened alongside it. Like
+// dbToWriter it is keyed by pointer and cleaned up by CloseWithWriter (via cleanupDB).
+var (
+	replicaMu    sync.RWMutex
+	replicaPools = make(map[*sql.DB]*replicaPool)
+)
+
+// registerReplicas opens a *sql.DB for each DSN in dbProperties.ReadReplicas and records them
+// against primary, so the trace interceptor can route eligible SELECTs to one of them. It is a
+// no-op if no read replicas are configured, which is the common case, or if the primary is SQLite.
+func registerReplicas(primary *sql.DB, dbProperties *config.DatabaseOptions) error {
+	if len(dbProperties.ReadReplicas) == 0 || dbProperties.ConnectionString.IsSQLite() {
+		return nil
+	}
+	if err := dbProperties.Verify(); err != nil {
+		return err
+	}
+	pool := &replicaPool{stop: make(chan struct{}), preferredDSN: string(dbProperties.ReplicaOverride)}
+	for _, dsn := range dbProperties.ReadReplicas {
+		rdb, err := sql.Open("postgres", string(dsn))
+		if err != nil {
+			return err
+		}
+		rdb.SetMaxOpenConns(dbProperties.MaxOpenConns())
+		rdb.SetMaxIdleConns(dbProperties.MaxIdleConns())
+		rdb.SetConnMaxLifetime(dbProperties.ConnMaxLifetime())
+		r := &replica{dsn: string(dsn), db: rdb, healthy: 1}
+		pool.replicas = append(pool.replicas, r)
+	}
+	pool.startHealthChecks()
+	replicaMu.Lock()
+	replicaPools[primary] = pool
+	replicaMu.Unlock()
+	return nil
+}
+
+func lookupReplicaPool(db *sql.DB) *replicaPool {
+	replicaMu.RLock()
+	defer replicaMu.RUnlock()
+	return replicaPools[db]
+}
+
+// queryReplica runs query directly against r, bypassing the primary connection the calling
+// driver.Stmt is bound to, and adapts the resulting *sql.Rows back into a driver.Rows so it can
+// be returned from StmtQueryContext as if it had come from the primary all along.
+func queryReplica(ctx context.Context, r *replica, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&r.inFlight, 1)
+	defer atomic.AddInt64(&r.inFlight, -1)
+
+	params := make([]interface{}, len(args))
+	for i, a := range args {
+		params[i] = a.Value
+	}
+	rows, err := r.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		r.markUnhealthy(err)
+		return nil, err
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	return &replicaRows{rows: rows, cols: cols}, nil
+}
+
+// replicaRows adapts a *sql.Rows obtained directly from a replica's *sql.DB to the driver.Rows
+// interface expected by the caller of StmtQueryContext.
+type replicaRows struct {
+	rows *sql.Rows
+	cols []string
+}
+
+func (r *replicaRows) Columns() []string { return r.cols }
+func (r *replicaRows) Close() error      { return r.rows.Close() }
+
+func (r *replicaRows) Next(dest []driver.Value) error {
+	scanned := make([]interface{}, len(dest))
+	for i := range scanned {
+		scanned[i] = new(interface{})
+	}
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	if err := r.rows.Scan(scanned...); err != nil {
+		return err
+	}
+	for i, v := range scanned {
+		dest[i] = driver.Value(*(v.(*interface{})))
+	}
+	return nil
+}
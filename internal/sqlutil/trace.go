@@ -20,106 +20,282 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/ngrok/sqlmw"
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var tracingEnabled = os.Getenv("DENDRITE_TRACE_SQL") == "1"
-var dbToWriter map[string]Writer
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Name:      "sql_query_duration_seconds",
+		Help:      "Time taken for a SQL statement to complete, by component and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"component", "op", "driver"})
+
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Name:      "sql_errors_total",
+		Help:      "The total number of SQL statements that returned an error.",
+	}, []string{"component", "op", "driver"})
+)
+
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/internal/sqlutil")
+
 var CtxDBInstance = "db_instance"
-var instCount = 0
 
+// dbToWriter maps a *sql.DB to the Writer it was opened with, so the trace interceptor can
+// look up which component issued a query from the context value alone. It is guarded by a
+// RWMutex since lookups on the query path vastly outnumber registrations. Entries are removed by
+// CloseWithWriter, not by garbage collection: the map itself holds a strong reference to every
+// *sql.DB it's keyed by, so a finalizer on that same pointer would never run while its entry is
+// still present. Callers that opened a *sql.DB via OpenWithWriter must close it with
+// CloseWithWriter, not db.Close(), or this entry (and its replica pool, if any) leaks for the
+// life of the process.
+var (
+	writerMu   sync.RWMutex
+	dbToWriter = make(map[*sql.DB]Writer)
+)
+
+func registerWriter(db *sql.DB, w Writer) {
+	writerMu.Lock()
+	dbToWriter[db] = w
+	writerMu.Unlock()
+}
+
+// cleanupDB removes every registry entry keyed by db, closing each replica pool opened alongside
+// it. It is called from CloseWithWriter, after db itself has been closed.
+func cleanupDB(db *sql.DB) {
+	writerMu.Lock()
+	delete(dbToWriter, db)
+	writerMu.Unlock()
+
+	replicaMu.Lock()
+	pool := replicaPools[db]
+	delete(replicaPools, db)
+	replicaMu.Unlock()
+	if pool != nil {
+		pool.close()
+	}
+}
+
+func lookupWriter(db *sql.DB) Writer {
+	writerMu.RLock()
+	defer writerMu.RUnlock()
+	return dbToWriter[db]
+}
+
+// traceInterceptor instruments every statement executed through it with an OpenTelemetry span
+// parented on the caller's context, and records Prometheus metrics keyed by component and
+// operation. A single traceInterceptor is shared, per driver name, across every *sql.DB opened
+// with that driver (see registerDrivers), so which *sql.DB a given call belongs to can only be
+// recovered from the context passed into that call: OpenWithWriter returns a ctx with the *sql.DB
+// stashed under CtxDBInstance for exactly this reason, and callers must derive every query's
+// context from it.
 type traceInterceptor struct {
 	sqlmw.NullInterceptor
 	conn driver.Conn
+	// driverName identifies the underlying database/sql driver, e.g. "postgres" or "sqlite3",
+	// and is attached to every span and metric emitted by this interceptor.
+	driverName string
+
+	rowSpansMu sync.Mutex
+	rowSpans   map[driver.Rows]trace.Span
+
+	// inTx is set for the lifetime of a transaction started against the primary via
+	// ConnBeginTx. Statements run while inTx is true always go to the primary: read/write
+	// splitting only applies to standalone queries, since a replica may not yet have replayed
+	// writes the transaction depends on seeing.
+	inTx bool
+}
+
+// dbFromContext recovers the *sql.DB a query was issued against from the context value
+// OpenWithWriter attaches, or nil if ctx didn't carry one (e.g. a query issued with a plain
+// context.Background() instead of the ctx OpenWithWriter returned).
+func dbFromContext(ctx context.Context) *sql.DB {
+	db, _ := ctx.Value(CtxDBInstance).(*sql.DB)
+	return db
+}
+
+func (in *traceInterceptor) component(ctx context.Context) string {
+	w := lookupWriter(dbFromContext(ctx))
+	if w == nil {
+		return "unknown"
+	}
+	return w.Safe()
+}
+
+func redact(query string) string {
+	// Replace anything that looks like a literal value so query text is safe to attach to a
+	// span or log line. Bound parameters already show up as placeholders, so this mostly
+	// catches ad-hoc literals that were concatenated into a query string by mistake.
+	return regexp.MustCompile(`'[^']*'`).ReplaceAllString(query, "'?'")
+}
+
+func opName(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// ConnBeginTx marks this connection as being inside a transaction for as long as the returned
+// driver.Tx is open, so StmtQueryContext knows to keep every statement on the primary until it's
+// committed or rolled back.
+func (in *traceInterceptor) ConnBeginTx(ctx context.Context, conn driver.ConnBeginTx, txOpts driver.TxOptions) (driver.Tx, error) {
+	tx, err := conn.BeginTx(ctx, txOpts)
+	if err != nil {
+		return nil, err
+	}
+	in.inTx = true
+	return &txInterceptor{Tx: tx, in: in}, nil
+}
+
+type txInterceptor struct {
+	driver.Tx
+	in *traceInterceptor
+}
+
+func (t *txInterceptor) Commit() error {
+	t.in.inTx = false
+	return t.Tx.Commit()
+}
+
+func (t *txInterceptor) Rollback() error {
+	t.in.inTx = false
+	return t.Tx.Rollback()
 }
 
 func (in *traceInterceptor) StmtQueryContext(ctx context.Context, stmt driver.StmtQueryContext, query string, args []driver.NamedValue) (driver.Rows, error) {
-	startedAt := time.Now()
-	rows, err := stmt.QueryContext(ctx, args)
-	key := ctx.Value(CtxDBInstance)
-	var safe string
-	if key != nil {
-		w := dbToWriter[key.(string)]
-		if w == nil {
-			safe = fmt.Sprintf("no writer for key %s", key)
-		} else {
-			safe = w.Safe()
+	component := in.component(ctx)
+	op := opName(query)
+	ctx, span := tracer.Start(ctx, "sql.query", trace.WithAttributes(
+		attribute.String("db.system", in.driverName),
+		attribute.String("db.statement", redact(query)),
+		attribute.String("db.dendrite.component", component),
+	))
+
+	if !in.inTx && op == "SELECT" {
+		if pool := lookupReplicaPool(dbFromContext(ctx)); pool != nil {
+			if r := pool.choose(); r != nil {
+				startedAt := time.Now()
+				rows, err := queryReplica(ctx, r, query, args)
+				in.observe(component, op, startedAt, err)
+				span.SetAttributes(attribute.String("db.dendrite.replica", r.dsn))
+				if err != nil {
+					span.RecordError(err)
+				}
+				span.End()
+				return rows, err
+			}
 		}
 	}
-	if safe != "" && !strings.HasPrefix(query, "SELECT ") {
-		logrus.Infof("unsafe: %s -- %s", safe, query)
-	}
 
-	logrus.WithField("duration", time.Since(startedAt)).WithField(logrus.ErrorKey, err).WithField("safe", safe).Debug("executed sql query ", query, " args: ", args)
+	startedAt := time.Now()
+	rows, err := stmt.QueryContext(ctx, args)
+	in.observe(component, op, startedAt, err)
 
+	if err != nil {
+		span.RecordError(err)
+		span.End()
+		return rows, err
+	}
+	// The span stays open until RowsNext sees io.EOF (or the caller never exhausts the rows,
+	// in which case it is ended best-effort when the interceptor is garbage collected along
+	// with its row map entry).
+	in.rowSpansMu.Lock()
+	if in.rowSpans == nil {
+		in.rowSpans = make(map[driver.Rows]trace.Span)
+	}
+	in.rowSpans[rows] = span
+	in.rowSpansMu.Unlock()
 	return rows, err
 }
 
 func (in *traceInterceptor) StmtExecContext(ctx context.Context, stmt driver.StmtExecContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	component := in.component(ctx)
+	op := opName(query)
+	ctx, span := tracer.Start(ctx, "sql.exec", trace.WithAttributes(
+		attribute.String("db.system", in.driverName),
+		attribute.String("db.statement", redact(query)),
+		attribute.String("db.dendrite.component", component),
+	))
+	defer span.End()
+
 	startedAt := time.Now()
 	result, err := stmt.ExecContext(ctx, args)
-	key := ctx.Value(CtxDBInstance)
-	var safe string
-	if key != nil {
-		w := dbToWriter[key.(string)]
-		if w == nil {
-			safe = fmt.Sprintf("no writer for key %s", key)
-		} else {
-			safe = w.Safe()
-		}
-	}
-	if safe != "" && !strings.HasPrefix(query, "SELECT ") {
-		logrus.Infof("unsafe: %s -- %s", safe, query)
+	in.observe(component, op, startedAt, err)
+	if err != nil {
+		span.RecordError(err)
 	}
-
-	logrus.WithField("duration", time.Since(startedAt)).WithField(logrus.ErrorKey, err).WithField("safe", safe).Debug("executed sql query ", query, " args: ", args)
-
 	return result, err
 }
 
+func (in *traceInterceptor) observe(component, op string, startedAt time.Time, err error) {
+	queryDuration.WithLabelValues(component, op, in.driverName).Observe(time.Since(startedAt).Seconds())
+	if err != nil && err != sql.ErrNoRows {
+		queryErrors.WithLabelValues(component, op, in.driverName).Inc()
+	}
+}
+
 func (in *traceInterceptor) RowsNext(c context.Context, rows driver.Rows, dest []driver.Value) error {
 	err := rows.Next(dest)
-	if err == io.EOF {
-		// For all cases, we call Next() n+1 times, the first to populate the initial dest, then eventually
-		// it will io.EOF. If we log on each Next() call we log the last element twice, so don't.
+	if err != io.EOF {
 		return err
 	}
-	cols := rows.Columns()
-	logrus.Debug(strings.Join(cols, " | "))
-
-	b := strings.Builder{}
-	for i, val := range dest {
-		b.WriteString(fmt.Sprintf("%q", val))
-		if i+1 <= len(dest)-1 {
-			b.WriteString(" | ")
-		}
+	// For all cases, we call Next() n+1 times, the first to populate the initial dest, then
+	// eventually it will io.EOF. The span covers the whole result set, so only end it here.
+	in.rowSpansMu.Lock()
+	span, ok := in.rowSpans[rows]
+	if ok {
+		delete(in.rowSpans, rows)
+	}
+	in.rowSpansMu.Unlock()
+	if ok {
+		span.End()
 	}
-	logrus.Debug(b.String())
 	return err
 }
 
+// OpenWithWriter opens dbProperties the same way Open does, additionally registering db against
+// w and, if configured, against a pool of read replicas. Callers must close the returned *sql.DB
+// with CloseWithWriter rather than calling db.Close() directly, so this registration is cleaned
+// up rather than leaking for the life of the process.
 func OpenWithWriter(dbProperties *config.DatabaseOptions, w Writer) (*sql.DB, context.Context, error) {
 	db, err := Open(dbProperties)
 	if err != nil {
 		return nil, nil, err
 	}
-	instCount++
-	ctxVal := fmt.Sprintf("%d", instCount)
-	dbToWriter[ctxVal] = w
-	ctx := context.WithValue(context.TODO(), CtxDBInstance, ctxVal)
+	registerWriter(db, w)
+	if err = registerReplicas(db, dbProperties); err != nil {
+		return nil, nil, err
+	}
+	ctx := context.WithValue(context.TODO(), CtxDBInstance, db)
 	return db, ctx, nil
 }
 
+// CloseWithWriter closes db and releases the bookkeeping OpenWithWriter registered for it
+// (its Writer entry and any read replica pool). It must be used instead of db.Close() for any
+// *sql.DB obtained from OpenWithWriter.
+func CloseWithWriter(db *sql.DB) error {
+	err := db.Close()
+	cleanupDB(db)
+	return err
+}
+
 // Open opens a database specified by its database driver name and a driver-specific data source name,
-// usually consisting of at least a database name and connection information. Includes tracing driver
-// if DENDRITE_TRACE_SQL=1
+// usually consisting of at least a database name and connection information. Every statement run
+// through the returned *sql.DB is traced with an OpenTelemetry span and Prometheus metrics.
 func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	var err error
 	var driverName, dsn string
@@ -136,21 +312,13 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	default:
 		return nil, fmt.Errorf("invalid database connection string %q", dbProperties.ConnectionString)
 	}
-	if tracingEnabled {
-		// install the wrapped driver
-		driverName += "-trace"
-	}
+	baseDriverName := driverName
+	driverName += "-trace"
 	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, err
 	}
-	if driverName != SQLiteDriverName() {
-		logrus.WithFields(logrus.Fields{
-			"MaxOpenConns":    dbProperties.MaxOpenConns,
-			"MaxIdleConns":    dbProperties.MaxIdleConns,
-			"ConnMaxLifetime": dbProperties.ConnMaxLifetime,
-			"dataSourceName":  regexp.MustCompile(`://[^@]*@`).ReplaceAllLiteralString(dsn, "://"),
-		}).Debug("Setting DB connection limits")
+	if baseDriverName != SQLiteDriverName() {
 		db.SetMaxOpenConns(dbProperties.MaxOpenConns())
 		db.SetMaxIdleConns(dbProperties.MaxIdleConns())
 		db.SetConnMaxLifetime(dbProperties.ConnMaxLifetime())
@@ -160,5 +328,4 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 
 func init() {
 	registerDrivers()
-	dbToWriter = make(map[string]Writer)
 }